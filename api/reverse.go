@@ -0,0 +1,113 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/yashasviy/idempotent-payments-api/ledger"
+	"github.com/yashasviy/idempotent-payments-api/models"
+	"github.com/yashasviy/idempotent-payments-api/outbox"
+)
+
+// ReverseHandler posts the inverse entries of a previously posted ledger
+// transaction, under a new idempotency key, leaving the original untouched.
+func ReverseHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req models.ReverseRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid Body", http.StatusBadRequest)
+			return
+		}
+		if req.TransactionID == "" {
+			http.Error(w, "Missing transaction_id", http.StatusBadRequest)
+			return
+		}
+
+		idempotencyKey := r.Header.Get("Idempotency-Key")
+		if idempotencyKey == "" {
+			http.Error(w, "Missing Idempotency-Key header", http.StatusBadRequest)
+			return
+		}
+
+		// Recovery check: if this reversal already exists, return the recorded result.
+		var existingID string
+		err := db.QueryRow("SELECT id FROM ledger_transactions WHERE idempotency_key = $1", idempotencyKey).Scan(&existingID)
+		switch err {
+		case nil:
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Db-Hit", "true")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status":         "success",
+				"message":        "Reversal Complete (Recovered)",
+				"transaction_id": existingID,
+			})
+			return
+		case sql.ErrNoRows:
+			// Safe to proceed; no prior record found.
+		default:
+			http.Error(w, "Database Error", http.StatusInternalServerError)
+			return
+		}
+
+		originalEntries, err := ledger.EntriesForTransaction(db, req.TransactionID)
+		if err != nil {
+			http.Error(w, "Database Error", http.StatusInternalServerError)
+			return
+		}
+		if len(originalEntries) == 0 {
+			http.Error(w, "Original transaction not found", http.StatusNotFound)
+			return
+		}
+
+		reversingEntries := make([]ledger.Entry, len(originalEntries))
+		for i, e := range originalEntries {
+			reversingEntries[i] = ledger.Entry{
+				AccountID: e.AccountID,
+				Currency:  e.Currency,
+				Direction: e.Direction.Opposite(),
+				Amount:    e.Amount,
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database Error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback() // no-op if already committed
+
+		transactionID, err := ledger.PostTransaction(tx, idempotencyKey, reversingEntries)
+		if err != nil {
+			if errors.Is(err, ledger.ErrInsufficientFunds) {
+				http.Error(w, "Insufficient Funds", http.StatusUnprocessableEntity)
+				return
+			}
+			http.Error(w, "Transaction Failed", http.StatusInternalServerError)
+			return
+		}
+
+		event := map[string]interface{}{
+			"transaction_id":          transactionID,
+			"reverses_transaction_id": req.TransactionID,
+			"idempotency_key":         idempotencyKey,
+		}
+		if err := outbox.InsertEvent(tx, "transfer.reversed", event); err != nil {
+			http.Error(w, "Failed to record transaction event", http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Commit Failed", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":         "success",
+			"message":        "Transfer Reversed",
+			"transaction_id": transactionID,
+		})
+	}
+}
@@ -3,14 +3,22 @@ package api
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"os"
 
+	"github.com/yashasviy/idempotent-payments-api/ledger"
 	"github.com/yashasviy/idempotent-payments-api/models"
+	"github.com/yashasviy/idempotent-payments-api/outbox"
 )
 
+// defaultCurrency is assumed when a transfer request omits one, so existing
+// clients built before multi-currency support keep working.
+const defaultCurrency = "USD"
+
 // TransferHandler processes a money transfer with idempotency and recovery guards.
+// It posts a debit/credit pair to the ledger instead of mutating accounts.balance.
 func TransferHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		chaosEnabled := os.Getenv("CHAOS_MODE") == "true"
@@ -20,6 +28,9 @@ func TransferHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Invalid Body", http.StatusBadRequest)
 			return
 		}
+		if req.Currency == "" {
+			req.Currency = defaultCurrency
+		}
 
 		idempotencyKey := r.Header.Get("Idempotency-Key")
 		if idempotencyKey == "" {
@@ -27,18 +38,20 @@ func TransferHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Recovery check: if the transaction already exists, return the recorded result.
-		var existingAmount float64
-		err := db.QueryRow("SELECT amount FROM transactions WHERE idempotency_key = $1", idempotencyKey).Scan(&existingAmount)
+		// Recovery check: if the ledger transaction already exists, return the recorded result.
+		var existingID string
+		err := db.QueryRow("SELECT id FROM ledger_transactions WHERE idempotency_key = $1", idempotencyKey).Scan(&existingID)
 		switch err {
 		case nil:
-			log.Println("Transaction recovered from database for idempotency key", idempotencyKey)
+			log.Println("Transaction recovered from ledger for idempotency key", idempotencyKey)
 			w.Header().Set("Content-Type", "application/json")
 			w.Header().Set("X-Db-Hit", "true")
 			json.NewEncoder(w).Encode(map[string]interface{}{
-				"status":  "success",
-				"message": "Transfer Complete (Recovered)",
-				"amount":  existingAmount,
+				"status":         "success",
+				"message":        "Transfer Complete (Recovered)",
+				"transaction_id": existingID,
+				"amount":         req.Amount,
+				"currency":       req.Currency,
 			})
 			return
 		case sql.ErrNoRows:
@@ -48,33 +61,48 @@ func TransferHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		tx, err := db.Begin()
+		badRequest, err := validateCurrency(db, req.FromID, req.ToID, req.Currency)
 		if err != nil {
 			http.Error(w, "Database Error", http.StatusInternalServerError)
 			return
 		}
-		defer tx.Rollback() // no-op if already committed
-
-		// Deduct from sender while ensuring sufficient balance in a single statement.
-		result, err := tx.Exec("UPDATE accounts SET balance = balance - $1 WHERE id = $2 AND balance >= $1", req.Amount, req.FromID)
-		if err != nil {
-			http.Error(w, "Transaction Failed", http.StatusInternalServerError)
+		if badRequest != "" {
+			http.Error(w, badRequest, http.StatusBadRequest)
 			return
 		}
 
-		rows, _ := result.RowsAffected()
-		if rows == 0 {
-			http.Error(w, "Insufficient Funds", http.StatusUnprocessableEntity)
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database Error", http.StatusInternalServerError)
 			return
 		}
+		defer tx.Rollback() // no-op if already committed
 
-		if _, err := tx.Exec("UPDATE accounts SET balance = balance + $1 WHERE id = $2", req.Amount, req.ToID); err != nil {
+		transactionID, err := ledger.PostTransaction(tx, idempotencyKey, []ledger.Entry{
+			{AccountID: req.FromID, Currency: req.Currency, Direction: ledger.Debit, Amount: req.Amount},
+			{AccountID: req.ToID, Currency: req.Currency, Direction: ledger.Credit, Amount: req.Amount},
+		})
+		if err != nil {
+			if errors.Is(err, ledger.ErrInsufficientFunds) {
+				http.Error(w, "Insufficient Funds", http.StatusUnprocessableEntity)
+				return
+			}
 			http.Error(w, "Transaction Failed", http.StatusInternalServerError)
 			return
 		}
 
-		if _, err := tx.Exec("INSERT INTO transactions (from_id, to_id, amount, idempotency_key) VALUES ($1, $2, $3, $4)", req.FromID, req.ToID, req.Amount, idempotencyKey); err != nil {
-			http.Error(w, "Failed to record transaction", http.StatusInternalServerError)
+		// Record the event in the same transaction as the ledger entries so
+		// downstream delivery survives a crash between commit and response.
+		event := map[string]interface{}{
+			"transaction_id":  transactionID,
+			"from_id":         req.FromID,
+			"to_id":           req.ToID,
+			"amount":          req.Amount,
+			"currency":        req.Currency,
+			"idempotency_key": idempotencyKey,
+		}
+		if err := outbox.InsertEvent(tx, "transfer.completed", event); err != nil {
+			http.Error(w, "Failed to record transaction event", http.StatusInternalServerError)
 			return
 		}
 
@@ -91,9 +119,34 @@ func TransferHandler(db *sql.DB) http.HandlerFunc {
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"status":  "success",
-			"message": "Transfer Complete",
-			"amount":  req.Amount,
+			"status":         "success",
+			"message":        "Transfer Complete",
+			"transaction_id": transactionID,
+			"amount":         req.Amount,
+			"currency":       req.Currency,
 		})
 	}
 }
+
+// validateCurrency rejects a transfer whose currency doesn't match the
+// native currency recorded for either account; the ledger has no FX
+// conversion, so a mismatch here would silently misprice the transfer.
+// It returns a non-empty client-facing message for a bad request, or a
+// non-nil error if the accounts couldn't be looked up at all.
+func validateCurrency(db *sql.DB, fromID, toID int, currency string) (badRequest string, err error) {
+	for _, accountID := range []int{fromID, toID} {
+		var accountCurrency string
+		err := db.QueryRow("SELECT currency FROM accounts WHERE id = $1", accountID).Scan(&accountCurrency)
+		switch err {
+		case nil:
+			if accountCurrency != currency {
+				return "Transfer currency does not match account currency", nil
+			}
+		case sql.ErrNoRows:
+			return "Unknown account", nil
+		default:
+			return "", err
+		}
+	}
+	return "", nil
+}
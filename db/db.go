@@ -17,6 +17,25 @@ func Initialize(db *sql.DB) {
 		log.Fatal("Failed to create accounts table:", err)
 	}
 
+	// Every account has a native currency; transfers are rejected at
+	// validation time if they don't match both sides.
+	queryAccountsCurrency := `ALTER TABLE accounts ADD COLUMN IF NOT EXISTS currency VARCHAR(8) NOT NULL DEFAULT 'USD';`
+
+	if _, err := db.Exec(queryAccountsCurrency); err != nil {
+		log.Fatal("Failed to add currency column to accounts table:", err)
+	}
+
+	// Credit-line accounts (e.g. an operator-provisioned funding/treasury
+	// account) are exempt from the overdraft guard below, since the ledger
+	// has no other way to get money into the system: every other account
+	// starts at a computed balance of 0 and can only receive funds debited
+	// from somewhere.
+	queryAccountsCreditLine := `ALTER TABLE accounts ADD COLUMN IF NOT EXISTS is_credit_line BOOLEAN NOT NULL DEFAULT false;`
+
+	if _, err := db.Exec(queryAccountsCreditLine); err != nil {
+		log.Fatal("Failed to add is_credit_line column to accounts table:", err)
+	}
+
 	// 2. Create Transactions Table
 	// UNIQUE constraint on idempotency_key
 	queryTransactions := `
@@ -33,4 +52,165 @@ func Initialize(db *sql.DB) {
 		log.Fatal("Failed to create transactions table:", err)
 	}
 
+	// 3. Create Transaction Events Table (transactional outbox)
+	// Written inside the same tx as the ledger entries so delivery is
+	// at-least-once even if the process crashes right after commit.
+	queryTransactionEvents := `
+	CREATE TABLE IF NOT EXISTS transaction_events (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		event_type VARCHAR(255) NOT NULL,
+		payload JSONB NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		delivered_at TIMESTAMP,
+		attempts INT NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	if _, err := db.Exec(queryTransactionEvents); err != nil {
+		log.Fatal("Failed to create transaction_events table:", err)
+	}
+
+	// 4. Create Dead Letter Table
+	// Holds outbox events that exhausted their retry budget, for manual
+	// inspection and recovery via the /outbox/{id}/retry endpoint.
+	queryDeadLetter := `
+	CREATE TABLE IF NOT EXISTS dead_letter (
+		id UUID PRIMARY KEY,
+		event_type VARCHAR(255) NOT NULL,
+		payload JSONB NOT NULL,
+		attempts INT NOT NULL,
+		failed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	if _, err := db.Exec(queryDeadLetter); err != nil {
+		log.Fatal("Failed to create dead_letter table:", err)
+	}
+
+	// 5. Create Ledger Tables
+	// Append-only double-entry ledger: ledger_transactions groups the
+	// entries posted for one idempotency key, ledger_entries holds the
+	// individual debit/credit rows. Balances are derived, never stored.
+	queryLedgerTransactions := `
+	CREATE TABLE IF NOT EXISTS ledger_transactions (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		idempotency_key VARCHAR(255) UNIQUE NOT NULL,
+		status VARCHAR(32) NOT NULL DEFAULT 'posted',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	if _, err := db.Exec(queryLedgerTransactions); err != nil {
+		log.Fatal("Failed to create ledger_transactions table:", err)
+	}
+
+	queryLedgerEntries := `
+	CREATE TABLE IF NOT EXISTS ledger_entries (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		transaction_id UUID NOT NULL REFERENCES ledger_transactions(id),
+		account_id INT NOT NULL,
+		currency VARCHAR(8) NOT NULL,
+		direction VARCHAR(6) NOT NULL CHECK (direction IN ('debit', 'credit')),
+		amount NUMERIC(20, 4) NOT NULL CHECK (amount > 0),
+		posted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	if _, err := db.Exec(queryLedgerEntries); err != nil {
+		log.Fatal("Failed to create ledger_entries table:", err)
+	}
+
+	queryLedgerEntriesIndex := `CREATE INDEX IF NOT EXISTS idx_ledger_entries_account ON ledger_entries (account_id, currency);`
+
+	if _, err := db.Exec(queryLedgerEntriesIndex); err != nil {
+		log.Fatal("Failed to create ledger_entries account index:", err)
+	}
+
+	// Rejects a debit that would drive an account's balance negative,
+	// replacing the `balance >= $1` race that used to live in the
+	// accounts UPDATE statement with a check enforced at insert time.
+	// Credit-line accounts (accounts.is_credit_line) are exempt, since
+	// something has to be able to fund the rest of the ledger.
+	queryBalanceGuardFn := `
+	CREATE OR REPLACE FUNCTION check_ledger_balance() RETURNS TRIGGER AS $$
+	DECLARE
+		current_balance NUMERIC(20, 4);
+		is_credit_line BOOLEAN;
+	BEGIN
+		IF NEW.direction = 'debit' THEN
+			SELECT accounts.is_credit_line INTO is_credit_line
+			FROM accounts WHERE accounts.id = NEW.account_id;
+
+			IF COALESCE(is_credit_line, false) THEN
+				RETURN NEW;
+			END IF;
+
+			PERFORM pg_advisory_xact_lock(hashtext(NEW.account_id::text || ':' || NEW.currency));
+
+			SELECT COALESCE(SUM(CASE direction WHEN 'credit' THEN amount ELSE -amount END), 0)
+			INTO current_balance
+			FROM ledger_entries
+			WHERE account_id = NEW.account_id AND currency = NEW.currency;
+
+			IF current_balance - NEW.amount < 0 THEN
+				RAISE EXCEPTION 'insufficient funds for account % in %', NEW.account_id, NEW.currency;
+			END IF;
+		END IF;
+
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql;`
+
+	if _, err := db.Exec(queryBalanceGuardFn); err != nil {
+		log.Fatal("Failed to create check_ledger_balance function:", err)
+	}
+
+	queryBalanceGuardTrigger := `
+	DROP TRIGGER IF EXISTS trg_check_ledger_balance ON ledger_entries;
+	CREATE TRIGGER trg_check_ledger_balance
+		BEFORE INSERT ON ledger_entries
+		FOR EACH ROW EXECUTE FUNCTION check_ledger_balance();`
+
+	if _, err := db.Exec(queryBalanceGuardTrigger); err != nil {
+		log.Fatal("Failed to create ledger balance guard trigger:", err)
+	}
+
+	// account_balances is a read-optimized view over the append-only
+	// ledger. It's refreshed periodically by ledger.RefreshBalances (see
+	// main.go) rather than per insert, so reads don't pay the SUM() cost
+	// without serializing every transfer against a matview lock.
+	queryAccountBalancesView := `
+	CREATE MATERIALIZED VIEW IF NOT EXISTS account_balances AS
+	SELECT
+		account_id,
+		currency,
+		SUM(CASE direction WHEN 'credit' THEN amount ELSE -amount END) AS balance
+	FROM ledger_entries
+	GROUP BY account_id, currency;`
+
+	if _, err := db.Exec(queryAccountBalancesView); err != nil {
+		log.Fatal("Failed to create account_balances view:", err)
+	}
+
+	queryAccountBalancesIndex := `CREATE UNIQUE INDEX IF NOT EXISTS idx_account_balances_pk ON account_balances (account_id, currency);`
+
+	if _, err := db.Exec(queryAccountBalancesIndex); err != nil {
+		log.Fatal("Failed to create account_balances index:", err)
+	}
+
+	// 6. Create Payment Operations Table
+	// Tracks the lifecycle of an async operation: inserted pending by the
+	// Idempotency middleware's async contract, updated to a terminal status
+	// by the operations worker pool once the handler has run.
+	queryPaymentOperations := `
+	CREATE TABLE IF NOT EXISTS payment_operations (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		idempotency_key VARCHAR(255) UNIQUE NOT NULL,
+		status VARCHAR(16) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'succeeded', 'failed')),
+		request_fingerprint VARCHAR(64) NOT NULL,
+		response_body JSONB,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	if _, err := db.Exec(queryPaymentOperations); err != nil {
+		log.Fatal("Failed to create payment_operations table:", err)
+	}
 }
@@ -0,0 +1,129 @@
+// Package ledger implements a double-entry ledger subsystem: every transfer
+// posts exactly two append-only entries (one debit, one credit) instead of
+// mutating a single accounts.balance column. This makes audits and reversals
+// straightforward and removes the balance >= $1 race that used to live in
+// the accounts UPDATE statement - overdraft protection is now enforced by a
+// trigger on ledger_entries (see db.Initialize) at insert time.
+package ledger
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/jackc/pgconn"
+)
+
+// Direction is which side of a ledger entry an amount is posted to.
+type Direction string
+
+const (
+	Debit  Direction = "debit"
+	Credit Direction = "credit"
+)
+
+// Opposite returns the direction that reverses d.
+func (d Direction) Opposite() Direction {
+	if d == Credit {
+		return Debit
+	}
+	return Credit
+}
+
+// ErrInsufficientFunds is returned when a debit would drive an account's
+// balance negative for its currency.
+var ErrInsufficientFunds = errors.New("ledger: insufficient funds")
+
+// insufficientFundsErrCode is the SQLSTATE for a plpgsql RAISE EXCEPTION,
+// which is how check_ledger_balance (see db.Initialize) signals an overdraft.
+const insufficientFundsErrCode = "P0001"
+
+// Entry is one leg of a ledger transaction: a single debit or credit against
+// one account in one currency.
+type Entry struct {
+	AccountID int
+	Currency  string
+	Direction Direction
+	Amount    float64
+}
+
+// Balance returns an account's current balance in the given currency,
+// computed from the append-only ledger_entries table.
+func Balance(db *sql.DB, accountID int, currency string) (float64, error) {
+	var balance float64
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(CASE direction WHEN 'credit' THEN amount ELSE -amount END), 0)
+		FROM ledger_entries
+		WHERE account_id = $1 AND currency = $2`, accountID, currency).Scan(&balance)
+	return balance, err
+}
+
+// RefreshBalances rebuilds the account_balances read-optimized view (see
+// db.Initialize) from the current ledger_entries. It's meant to be called
+// periodically from a background goroutine rather than per-write, so a read
+// of account_balances can lag slightly behind Balance's live SUM.
+func RefreshBalances(db *sql.DB) error {
+	_, err := db.Exec("REFRESH MATERIALIZED VIEW CONCURRENTLY account_balances")
+	return err
+}
+
+// PostTransaction opens a new ledger transaction under idempotencyKey and
+// posts entries to it within tx, returning the new transaction's id. It
+// returns ErrInsufficientFunds if any debit would overdraw its account.
+func PostTransaction(tx *sql.Tx, idempotencyKey string, entries []Entry) (string, error) {
+	var transactionID string
+	err := tx.QueryRow(
+		"INSERT INTO ledger_transactions (idempotency_key) VALUES ($1) RETURNING id",
+		idempotencyKey,
+	).Scan(&transactionID)
+	if err != nil {
+		return "", err
+	}
+
+	for _, e := range entries {
+		if _, err := tx.Exec(
+			`INSERT INTO ledger_entries (transaction_id, account_id, currency, direction, amount)
+			 VALUES ($1, $2, $3, $4, $5)`,
+			transactionID, e.AccountID, e.Currency, e.Direction, e.Amount,
+		); err != nil {
+			return "", translateInsertErr(err)
+		}
+	}
+
+	return transactionID, nil
+}
+
+// EntriesForTransaction returns the entries posted under transactionID,
+// ordered by posted_at. Entries posted in one SQL transaction share the same
+// posted_at, so their order relative to each other is not defined. Used to
+// compute the inverse entries for a reversal.
+func EntriesForTransaction(db *sql.DB, transactionID string) ([]Entry, error) {
+	rows, err := db.Query(
+		`SELECT account_id, currency, direction, amount
+		 FROM ledger_entries
+		 WHERE transaction_id = $1
+		 ORDER BY posted_at`, transactionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		var e Entry
+		if err := rows.Scan(&e.AccountID, &e.Currency, &e.Direction, &e.Amount); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// translateInsertErr maps the overdraft-guard trigger's RAISE EXCEPTION into
+// ErrInsufficientFunds so callers can branch on it without parsing SQL errors.
+func translateInsertErr(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == insufficientFundsErrCode {
+		return ErrInsufficientFunds
+	}
+	return err
+}
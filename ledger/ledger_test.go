@@ -0,0 +1,48 @@
+package ledger
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgconn"
+)
+
+func TestDirectionOpposite(t *testing.T) {
+	cases := []struct {
+		in   Direction
+		want Direction
+	}{
+		{Debit, Credit},
+		{Credit, Debit},
+	}
+	for _, c := range cases {
+		if got := c.in.Opposite(); got != c.want {
+			t.Errorf("%s.Opposite() = %s, want %s", c.in, got, c.want)
+		}
+	}
+}
+
+func TestTranslateInsertErr(t *testing.T) {
+	t.Run("overdraft trigger error maps to ErrInsufficientFunds", func(t *testing.T) {
+		pgErr := &pgconn.PgError{Code: insufficientFundsErrCode, Message: "insufficient funds for account 1 in USD"}
+		got := translateInsertErr(pgErr)
+		if !errors.Is(got, ErrInsufficientFunds) {
+			t.Errorf("translateInsertErr(%v) = %v, want ErrInsufficientFunds", pgErr, got)
+		}
+	})
+
+	t.Run("unrelated pg error passes through unchanged", func(t *testing.T) {
+		pgErr := &pgconn.PgError{Code: "23505", Message: "duplicate key"}
+		got := translateInsertErr(pgErr)
+		if got != error(pgErr) {
+			t.Errorf("translateInsertErr(%v) = %v, want unchanged", pgErr, got)
+		}
+	})
+
+	t.Run("non-pg error passes through unchanged", func(t *testing.T) {
+		want := errors.New("connection reset")
+		if got := translateInsertErr(want); got != want {
+			t.Errorf("translateInsertErr(%v) = %v, want unchanged", want, got)
+		}
+	})
+}
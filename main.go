@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
@@ -14,8 +15,16 @@ import (
 
 	"github.com/yashasviy/idempotent-payments-api/api"
 	"github.com/yashasviy/idempotent-payments-api/db"
+	"github.com/yashasviy/idempotent-payments-api/ledger"
+	"github.com/yashasviy/idempotent-payments-api/middleware"
+	"github.com/yashasviy/idempotent-payments-api/operations"
+	"github.com/yashasviy/idempotent-payments-api/outbox"
 )
 
+// balanceRefreshInterval is how often account_balances is rebuilt from
+// ledger_entries.
+const balanceRefreshInterval = 30 * time.Second
+
 func main() {
 	// 1. Connect to Redis
 	rdb := redis.NewClient(&redis.Options{
@@ -49,11 +58,42 @@ func main() {
 	// 3. Initialize Tables
 	db.Initialize(database)
 
-	// 4. Setup Router
+	// 4. Start the outbox dispatcher
+	dispatcher := outbox.NewDispatcher(database, os.Getenv("WEBHOOK_URL"))
+	go dispatcher.Run(context.Background())
+
+	// 4b. Periodically rebuild the account_balances read view.
+	go func() {
+		ticker := time.NewTicker(balanceRefreshInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := ledger.RefreshBalances(database); err != nil {
+				log.Printf("Failed to refresh account_balances: %v", err)
+			}
+		}
+	}()
+
+	// 5. Start the async operations worker pool
+	opsQueue := operations.NewQueue(rdb)
+	opsPool := operations.NewWorkerPool(opsQueue, database, api.TransferHandler(database), operations.DefaultConcurrency)
+	go opsPool.Run(context.Background())
+
+	// 6. Setup Router
 	r := chi.NewRouter()
 
-	// TODO: Idempotency Middleware
-	r.Post("/transfer", api.TransferHandler(database))
+	// Mutating routes go through the idempotency middleware so retried
+	// requests replay their original response instead of double-processing.
+	r.With(middleware.Idempotency(rdb)).Post("/transfer", api.TransferHandler(database))
+	r.With(middleware.Idempotency(rdb)).Post("/reverse", api.ReverseHandler(database))
+
+	// Async variant: accepts the transfer, returns 202 immediately, and
+	// lets the caller poll GET /operations/{id} for the result.
+	r.With(middleware.Idempotency(rdb, middleware.Async(database, opsQueue))).Post("/transfer/async", api.TransferHandler(database))
+	r.Get("/operations/{id}", operations.OperationHandler(database))
+
+	// Admin endpoints for outbox operator recovery.
+	r.Get("/outbox/pending", outbox.PendingHandler(database))
+	r.Post("/outbox/{id}/retry", outbox.RetryHandler(database))
 
 	fmt.Println("Idempotency API running on port 8080...")
 	http.ListenAndServe(":8080", r)
@@ -0,0 +1,177 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/jackc/pgconn"
+
+	"github.com/yashasviy/idempotent-payments-api/operations"
+)
+
+// uniqueViolationErrCode is the SQLSTATE Postgres raises when two requests
+// race to insert the same idempotency_key.
+const uniqueViolationErrCode = "23505"
+
+// Enqueuer hands an operations.Job off to whatever backs the async worker
+// pool. operations.Queue satisfies this.
+type Enqueuer interface {
+	Enqueue(ctx context.Context, job operations.Job) error
+}
+
+// asyncConfig holds the async contract's dependencies; it's nil-ish (zero
+// value) until an Option sets it, which is how Idempotency tells the two
+// contracts apart.
+type asyncConfig struct {
+	db    *sql.DB
+	queue Enqueuer
+}
+
+// Option customizes an Idempotency middleware instance.
+type Option func(*asyncConfig)
+
+// Async opts a route into the asynchronous idempotency contract: the first
+// request for a key is persisted as a pending payment_operations row and
+// handed to queue for background processing by a worker pool, returning 202
+// with a Location header instead of blocking for the result.
+func Async(db *sql.DB, queue Enqueuer) Option {
+	return func(c *asyncConfig) {
+		c.db = db
+		c.queue = queue
+	}
+}
+
+// serveAsync implements the asynchronous Idempotency contract:
+//  1. Extract idempotency key from request headers
+//  2. Compute a fingerprint over method, path, and raw body
+//  3. Look up an existing payment_operations row for that key
+//     - if the fingerprint matches, return its current status (and the
+//     response body once it reaches a terminal state)
+//     - if it doesn't, reject with 422 idempotency_key_reuse
+//  4. Otherwise insert a new pending row and enqueue a job for the worker
+//     pool, returning 202 with Location: /operations/{id}
+//
+// A unique-key insert race is resolved by re-reading the row the other
+// request just created rather than failing with 409, so concurrent
+// duplicates converge on the same pending status instead of hard-failing.
+func serveAsync(cfg *asyncConfig, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	idempotencyKey := r.Header.Get(IdempotencyHeader)
+	if idempotencyKey == "" {
+		// No idempotency key provided - process request normally.
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	rawBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	r.Body.Close()
+	reqFingerprint := fingerprint(r, rawBody)
+
+	id, status, storedFingerprint, responseBody, err := lookupOperation(cfg.db, idempotencyKey)
+	switch {
+	case err == nil:
+		if storedFingerprint != reqFingerprint {
+			log.Printf("[Idempotency] Key reuse detected: %s", idempotencyKey)
+			writeKeyReuseError(w)
+			return
+		}
+		writeOperationStatus(w, id, status, responseBody)
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		// First use of this key; fall through to create the operation.
+	default:
+		log.Printf("[Idempotency] Operation lookup error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	id, err = createOperation(cfg.db, idempotencyKey, reqFingerprint)
+	if isUniqueViolation(err) {
+		// Lost the race to insert - another request already owns this key.
+		// Converge on its pending status instead of a 409 conflict.
+		id, status, storedFingerprint, responseBody, err = lookupOperation(cfg.db, idempotencyKey)
+		if err != nil {
+			log.Printf("[Idempotency] Operation lookup error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if storedFingerprint != reqFingerprint {
+			writeKeyReuseError(w)
+			return
+		}
+		writeOperationStatus(w, id, status, responseBody)
+		return
+	}
+	if err != nil {
+		log.Printf("[Idempotency] Failed to create operation: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	job := operations.Job{
+		OperationID: id,
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		Body:        rawBody,
+		Headers:     r.Header,
+	}
+	if err := cfg.queue.Enqueue(r.Context(), job); err != nil {
+		log.Printf("[Idempotency] Failed to enqueue operation %s: %v", id, err)
+	}
+
+	w.Header().Set("Location", "/operations/"+id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"id": id, "status": operations.StatusPending})
+}
+
+func lookupOperation(db *sql.DB, idempotencyKey string) (id, status, fingerprint string, responseBody []byte, err error) {
+	var body sql.NullString
+	err = db.QueryRow(
+		"SELECT id, status, request_fingerprint, response_body FROM payment_operations WHERE idempotency_key = $1",
+		idempotencyKey,
+	).Scan(&id, &status, &fingerprint, &body)
+	if body.Valid {
+		responseBody = []byte(body.String)
+	}
+	return id, status, fingerprint, responseBody, err
+}
+
+func createOperation(db *sql.DB, idempotencyKey, fingerprint string) (string, error) {
+	var id string
+	err := db.QueryRow(
+		`INSERT INTO payment_operations (idempotency_key, status, request_fingerprint)
+		 VALUES ($1, $2, $3) RETURNING id`,
+		idempotencyKey, operations.StatusPending, fingerprint,
+	).Scan(&id)
+	return id, err
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolationErrCode
+}
+
+// writeOperationStatus replies with an operation's current status and, once
+// it has a terminal outcome, the response body its handler produced.
+func writeOperationStatus(w http.ResponseWriter, id, status string, responseBody []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Idempotency-Hit", "true")
+
+	if status == operations.StatusPending || responseBody == nil {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"id": id, "status": status})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseBody)
+}
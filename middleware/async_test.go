@@ -0,0 +1,171 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgconn"
+
+	"github.com/yashasviy/idempotent-payments-api/operations"
+)
+
+type fakeEnqueuer struct {
+	jobs []operations.Job
+}
+
+func (f *fakeEnqueuer) Enqueue(ctx context.Context, job operations.Job) error {
+	f.jobs = append(f.jobs, job)
+	return nil
+}
+
+func noopHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("should not be called directly by the async contract")
+	})
+}
+
+func TestServeAsync_FirstRequestEnqueuesAndReturns202(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT id, status, request_fingerprint, response_body FROM payment_operations WHERE idempotency_key = \\$1").
+		WithArgs("key-1").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("INSERT INTO payment_operations").
+		WithArgs("key-1", operations.StatusPending, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("op-1"))
+
+	queue := &fakeEnqueuer{}
+	cfg := &asyncConfig{db: db, queue: queue}
+
+	req := httptest.NewRequest(http.MethodPost, "/transfer/async", bytes.NewReader([]byte(`{"amount":10}`)))
+	req.Header.Set(IdempotencyHeader, "key-1")
+	w := httptest.NewRecorder()
+
+	serveAsync(cfg, noopHandler(), w, req)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d (body: %s)", w.Code, http.StatusAccepted, w.Body.String())
+	}
+	if w.Header().Get("Location") != "/operations/op-1" {
+		t.Errorf("Location = %q, want /operations/op-1", w.Header().Get("Location"))
+	}
+	if len(queue.jobs) != 1 || queue.jobs[0].OperationID != "op-1" {
+		t.Errorf("expected one enqueued job for op-1, got %+v", queue.jobs)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestServeAsync_MatchingKeyReplaysPendingStatus(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	defer db.Close()
+
+	body := []byte(`{"amount":10}`)
+	fp := fingerprint(httptest.NewRequest(http.MethodPost, "/transfer/async", nil), body)
+
+	mock.ExpectQuery("SELECT id, status, request_fingerprint, response_body FROM payment_operations WHERE idempotency_key = \\$1").
+		WithArgs("key-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status", "request_fingerprint", "response_body"}).
+			AddRow("op-1", operations.StatusPending, fp, nil))
+
+	queue := &fakeEnqueuer{}
+	cfg := &asyncConfig{db: db, queue: queue}
+
+	req := httptest.NewRequest(http.MethodPost, "/transfer/async", bytes.NewReader(body))
+	req.Header.Set(IdempotencyHeader, "key-1")
+	w := httptest.NewRecorder()
+
+	serveAsync(cfg, noopHandler(), w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d (body: %s)", w.Code, http.StatusOK, w.Body.String())
+	}
+	if len(queue.jobs) != 0 {
+		t.Errorf("replay should not enqueue a new job, got %+v", queue.jobs)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestServeAsync_MismatchedFingerprintRejected(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT id, status, request_fingerprint, response_body FROM payment_operations WHERE idempotency_key = \\$1").
+		WithArgs("key-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status", "request_fingerprint", "response_body"}).
+			AddRow("op-1", operations.StatusPending, "some-other-fingerprint", nil))
+
+	cfg := &asyncConfig{db: db, queue: &fakeEnqueuer{}}
+
+	req := httptest.NewRequest(http.MethodPost, "/transfer/async", bytes.NewReader([]byte(`{"amount":10}`)))
+	req.Header.Set(IdempotencyHeader, "key-1")
+	w := httptest.NewRecorder()
+
+	serveAsync(cfg, noopHandler(), w, req)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d (body: %s)", w.Code, http.StatusUnprocessableEntity, w.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestServeAsync_RaceToInsertConvergesOnPending(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	defer db.Close()
+
+	body := []byte(`{"amount":10}`)
+	fp := fingerprint(httptest.NewRequest(http.MethodPost, "/transfer/async", nil), body)
+
+	mock.ExpectQuery("SELECT id, status, request_fingerprint, response_body FROM payment_operations WHERE idempotency_key = \\$1").
+		WithArgs("key-1").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("INSERT INTO payment_operations").
+		WithArgs("key-1", operations.StatusPending, sqlmock.AnyArg()).
+		WillReturnError(&pgconn.PgError{Code: uniqueViolationErrCode, Message: "duplicate key value"})
+	mock.ExpectQuery("SELECT id, status, request_fingerprint, response_body FROM payment_operations WHERE idempotency_key = \\$1").
+		WithArgs("key-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status", "request_fingerprint", "response_body"}).
+			AddRow("op-1", operations.StatusPending, fp, nil))
+
+	queue := &fakeEnqueuer{}
+	cfg := &asyncConfig{db: db, queue: queue}
+
+	req := httptest.NewRequest(http.MethodPost, "/transfer/async", bytes.NewReader(body))
+	req.Header.Set(IdempotencyHeader, "key-1")
+	w := httptest.NewRecorder()
+
+	serveAsync(cfg, noopHandler(), w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d (not a 409) (body: %s)", w.Code, http.StatusOK, w.Body.String())
+	}
+	if len(queue.jobs) != 0 {
+		t.Errorf("the losing request should not enqueue its own job, got %+v", queue.jobs)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
@@ -3,9 +3,13 @@ package middleware
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -28,8 +32,14 @@ const (
 	LockKeyPrefix = "lock:"
 )
 
+// replayedHeaders lists the response headers that are captured alongside a
+// cached body and replayed verbatim on a cache hit. Only headers that
+// clients actually depend on for parsing/observability are kept; anything
+// else (e.g. Date) is regenerated per-response.
+var replayedHeaders = []string{"Content-Type", "X-Db-Hit"}
+
 // responseWriterWrapper captures HTTP responses for caching.
-// It intercepts both the status code and response body to store in Redis.
+// It intercepts the status code, response body, and headers to store in Redis.
 type responseWriterWrapper struct {
 	http.ResponseWriter
 	statusCode int
@@ -48,87 +58,184 @@ func (rw *responseWriterWrapper) Write(b []byte) (int, error) {
 	return rw.ResponseWriter.Write(b)
 }
 
+// fingerprint computes a stable hash of the parts of a request that must
+// match for a replay to be safe: method, path, and raw body.
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method))
+	h.Write([]byte{0})
+	h.Write([]byte(r.URL.Path))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeKeyReuseError responds with a structured 422 when an idempotency key
+// is replayed against a request that doesn't match the one it was first
+// used with, instead of silently serving the earlier response.
+func writeKeyReuseError(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":   "idempotency_key_reuse",
+		"message": "key was previously used with a different request body",
+	})
+}
+
 // Idempotency is middleware that implements request idempotency using Redis.
-// It prevents duplicate processing of identical requests by caching responses.
+// It prevents duplicate processing of identical requests by caching responses,
+// and guards against key reuse across different request bodies.
+//
+// By default it follows the synchronous contract below. Passing Async opts
+// the route into the asynchronous contract instead (see async.go): the first
+// request is persisted as a pending operation and handed off to a worker
+// pool, returning 202 immediately rather than blocking for the result.
 //
-// Flow:
+// Synchronous flow:
 //  1. Extract idempotency key from request headers
-//  2. Check Redis cache for existing response
-//  3. Acquire distributed lock to prevent race conditions
-//  4. Process request if not cached
-//  5. Store successful responses in Redis with TTL
+//  2. Compute a fingerprint over method, path, and raw body
+//  3. Check Redis cache for an existing response under that key
+//     - if the fingerprint matches, replay the cached status/headers/body
+//     - if it doesn't, reject with 422 idempotency_key_reuse
+//  4. Acquire distributed lock to prevent race conditions
+//  5. Process request if not cached
+//  6. Store terminal responses (2xx and 4xx) in Redis with TTL
+func Idempotency(rdb *redis.Client, opts ...Option) func(http.Handler) http.Handler {
+	cfg := &asyncConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
 
-func Idempotency(rdb *redis.Client) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ctx := context.Background()
-
-			// Extract idempotency key from standard header
-			idempotencyKey := r.Header.Get(IdempotencyHeader)
-			if idempotencyKey == "" {
-				// No idempotency key provided - process request normally
-				next.ServeHTTP(w, r)
+			if cfg.queue != nil {
+				serveAsync(cfg, next, w, r)
 				return
 			}
+			serveSync(rdb, next, w, r)
+		})
+	}
+}
 
-			// Namespace keys to avoid collisions
-			cacheKey := RedisKeyPrefix + idempotencyKey
-			lockKey := LockKeyPrefix + idempotencyKey
-
-			// Check if this request was previously processed
-			cachedResponse, err := rdb.Get(ctx, cacheKey).Result()
-			if err == nil {
-				// Cache hit - return stored response immediately
-				log.Printf("[Idempotency] Cache hit for key: %s", idempotencyKey)
-				w.Header().Set("Content-Type", "application/json")
-				w.Header().Set("X-Idempotency-Hit", "true")
-				w.Write([]byte(cachedResponse))
-				return
-			}
+// serveSync implements the synchronous Idempotency contract documented above.
+func serveSync(rdb *redis.Client, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
 
-			// Acquire distributed lock to prevent concurrent duplicate requests
-			acquired, err := rdb.SetNX(ctx, lockKey, "processing", LockTimeout).Result()
-			if err != nil {
-				log.Printf("[Idempotency] Lock acquisition error: %v", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-				return
-			}
+	// Extract idempotency key from standard header
+	idempotencyKey := r.Header.Get(IdempotencyHeader)
+	if idempotencyKey == "" {
+		// No idempotency key provided - process request normally
+		next.ServeHTTP(w, r)
+		return
+	}
 
-			if !acquired {
-				// Another request with same key is currently processing
-				log.Printf("[Idempotency] Concurrent request detected: %s", idempotencyKey)
-				errorResponse := map[string]string{
-					"error":   "conflict",
-					"message": "A request with this idempotency key is currently being processed",
-				}
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusConflict)
-				json.NewEncoder(w).Encode(errorResponse)
-				return
-			}
+	// Buffer the raw body so it can be fingerprinted here and still
+	// read normally by the wrapped handler.
+	rawBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(rawBody))
+	reqFingerprint := fingerprint(r, rawBody)
+
+	// Namespace keys to avoid collisions
+	cacheKey := RedisKeyPrefix + idempotencyKey
+	lockKey := LockKeyPrefix + idempotencyKey
+
+	// Check if this request was previously processed
+	cached, err := rdb.HGetAll(ctx, cacheKey).Result()
+	if err != nil {
+		log.Printf("[Idempotency] Cache lookup error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 
-			// Ensure lock is released after processing
-			defer func() {
-				if err := rdb.Del(ctx, lockKey).Err(); err != nil {
-					log.Printf("[Idempotency] Failed to release lock: %v", err)
-				}
-			}()
-
-			// Process the request and capture response
-			wrapper := &responseWriterWrapper{
-				ResponseWriter: w,
-				statusCode:     http.StatusOK,
+	if storedFingerprint, ok := cached["fingerprint"]; ok {
+		if storedFingerprint != reqFingerprint {
+			log.Printf("[Idempotency] Key reuse detected: %s", idempotencyKey)
+			writeKeyReuseError(w)
+			return
+		}
+
+		// Cache hit with a matching request - replay the stored response.
+		log.Printf("[Idempotency] Cache hit for key: %s", idempotencyKey)
+		var headers map[string]string
+		if err := json.Unmarshal([]byte(cached["headers"]), &headers); err == nil {
+			for k, v := range headers {
+				w.Header().Set(k, v)
 			}
-			next.ServeHTTP(wrapper, r)
-
-			// Cache successful responses only (2xx status codes)
-			if wrapper.statusCode >= 200 && wrapper.statusCode < 300 {
-				if err := rdb.Set(ctx, cacheKey, wrapper.body.String(), IdempotencyCacheTTL).Err(); err != nil {
-					log.Printf("[Idempotency] Failed to cache response: %v", err)
-				} else {
-					log.Printf("[Idempotency] Cached response for key: %s (TTL: %v)", idempotencyKey, IdempotencyCacheTTL)
-				}
+		}
+		w.Header().Set("X-Idempotency-Hit", "true")
+		status, _ := strconv.Atoi(cached["status"])
+		w.WriteHeader(status)
+		w.Write([]byte(cached["body"]))
+		return
+	}
+
+	// Acquire distributed lock to prevent concurrent duplicate requests
+	acquired, err := rdb.SetNX(ctx, lockKey, "processing", LockTimeout).Result()
+	if err != nil {
+		log.Printf("[Idempotency] Lock acquisition error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !acquired {
+		// Another request with same key is currently processing
+		log.Printf("[Idempotency] Concurrent request detected: %s", idempotencyKey)
+		errorResponse := map[string]string{
+			"error":   "conflict",
+			"message": "A request with this idempotency key is currently being processed",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errorResponse)
+		return
+	}
+
+	// Ensure lock is released after processing
+	defer func() {
+		if err := rdb.Del(ctx, lockKey).Err(); err != nil {
+			log.Printf("[Idempotency] Failed to release lock: %v", err)
+		}
+	}()
+
+	// Process the request and capture response
+	wrapper := &responseWriterWrapper{
+		ResponseWriter: w,
+		statusCode:     http.StatusOK,
+	}
+	next.ServeHTTP(wrapper, r)
+
+	// Cache terminal responses only: 2xx successes and 4xx client
+	// errors (e.g. validation failures) get deterministic replays;
+	// 5xx and the 409 conflict above are left to retry.
+	status := wrapper.statusCode
+	if (status >= 200 && status < 300) || (status >= 400 && status < 500) {
+		headers := map[string]string{}
+		for _, h := range replayedHeaders {
+			if v := wrapper.Header().Get(h); v != "" {
+				headers[h] = v
 			}
-		})
+		}
+		headersJSON, _ := json.Marshal(headers)
+
+		err := rdb.HSet(ctx, cacheKey, map[string]interface{}{
+			"fingerprint": reqFingerprint,
+			"status":      status,
+			"body":        wrapper.body.String(),
+			"headers":     string(headersJSON),
+		}).Err()
+		if err != nil {
+			log.Printf("[Idempotency] Failed to cache response: %v", err)
+			return
+		}
+		if err := rdb.Expire(ctx, cacheKey, IdempotencyCacheTTL).Err(); err != nil {
+			log.Printf("[Idempotency] Failed to set cache TTL: %v", err)
+			return
+		}
+		log.Printf("[Idempotency] Cached response for key: %s (TTL: %v)", idempotencyKey, IdempotencyCacheTTL)
 	}
 }
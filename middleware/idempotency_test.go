@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestRedis(t *testing.T) *redis.Client {
+	t.Helper()
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis.Run: %v", err)
+	}
+	t.Cleanup(s.Close)
+	return redis.NewClient(&redis.Options{Addr: s.Addr()})
+}
+
+func countingHandler(calls *int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status":"success"}`))
+	})
+}
+
+func TestIdempotency_ReplaysDuplicateKey(t *testing.T) {
+	rdb := newTestRedis(t)
+	var calls int
+	handler := Idempotency(rdb)(countingHandler(&calls))
+
+	body := []byte(`{"from_id":1,"to_id":2,"amount":10}`)
+
+	req1 := httptest.NewRequest(http.MethodPost, "/transfer", bytes.NewReader(body))
+	req1.Header.Set(IdempotencyHeader, "key-1")
+	w1 := httptest.NewRecorder()
+	handler.ServeHTTP(w1, req1)
+
+	if w1.Code != http.StatusOK || calls != 1 {
+		t.Fatalf("first request: status=%d calls=%d, want 200/1", w1.Code, calls)
+	}
+	if w1.Header().Get("X-Idempotency-Hit") != "" {
+		t.Errorf("first request should not be marked as a cache hit")
+	}
+
+	req2 := httptest.NewRequest(http.MethodPost, "/transfer", bytes.NewReader(body))
+	req2.Header.Set(IdempotencyHeader, "key-1")
+	w2 := httptest.NewRecorder()
+	handler.ServeHTTP(w2, req2)
+
+	if calls != 1 {
+		t.Errorf("replayed request reached the handler again, calls = %d, want 1", calls)
+	}
+	if w2.Code != http.StatusOK {
+		t.Errorf("replay status = %d, want %d", w2.Code, http.StatusOK)
+	}
+	if w2.Header().Get("X-Idempotency-Hit") != "true" {
+		t.Errorf("replay missing X-Idempotency-Hit header")
+	}
+	if w2.Body.String() != w1.Body.String() {
+		t.Errorf("replay body = %q, want %q", w2.Body.String(), w1.Body.String())
+	}
+}
+
+func TestIdempotency_RejectsKeyReuseWithDifferentBody(t *testing.T) {
+	rdb := newTestRedis(t)
+	var calls int
+	handler := Idempotency(rdb)(countingHandler(&calls))
+
+	req1 := httptest.NewRequest(http.MethodPost, "/transfer", bytes.NewReader([]byte(`{"amount":10}`)))
+	req1.Header.Set(IdempotencyHeader, "key-1")
+	handler.ServeHTTP(httptest.NewRecorder(), req1)
+
+	req2 := httptest.NewRequest(http.MethodPost, "/transfer", bytes.NewReader([]byte(`{"amount":20}`)))
+	req2.Header.Set(IdempotencyHeader, "key-1")
+	w2 := httptest.NewRecorder()
+	handler.ServeHTTP(w2, req2)
+
+	if calls != 1 {
+		t.Errorf("handler called %d times, want 1 (second request should be rejected before reaching it)", calls)
+	}
+	if w2.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d", w2.Code, http.StatusUnprocessableEntity)
+	}
+
+	var resp map[string]string
+	if err := json.Unmarshal(w2.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response not valid JSON: %v", err)
+	}
+	if resp["error"] != "idempotency_key_reuse" {
+		t.Errorf("error = %q, want idempotency_key_reuse", resp["error"])
+	}
+}
+
+func TestIdempotency_NoKeyAlwaysInvokesHandler(t *testing.T) {
+	rdb := newTestRedis(t)
+	var calls int
+	handler := Idempotency(rdb)(countingHandler(&calls))
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/transfer", bytes.NewReader([]byte(`{}`)))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if calls != 2 {
+		t.Errorf("handler called %d times without an idempotency key, want 2", calls)
+	}
+}
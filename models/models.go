@@ -11,7 +11,14 @@ type Transaction struct {
 
 // TransferRequest is what the user sends in the API call
 type TransferRequest struct {
-	FromID int     `json:"from_id"`
-	ToID   int     `json:"to_id"`
-	Amount float64 `json:"amount"`
+	FromID   int     `json:"from_id"`
+	ToID     int     `json:"to_id"`
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency"`
+}
+
+// ReverseRequest is what the user sends to reverse a previously posted
+// ledger transaction.
+type ReverseRequest struct {
+	TransactionID string `json:"transaction_id"`
 }
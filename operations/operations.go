@@ -0,0 +1,231 @@
+// Package operations implements asynchronous long-running request handling:
+// a handler can be processed in the background by a worker pool instead of
+// inline, with the caller polling GET /operations/{id} for the result. This
+// is what middleware.Async wires a route up to.
+package operations
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// StatusPending means the operation was accepted but hasn't finished.
+	StatusPending = "pending"
+	// StatusSucceeded means the handler returned a 2xx response.
+	StatusSucceeded = "succeeded"
+	// StatusFailed means the handler rejected or errored on the request
+	// (4xx validation failures as well as 5xx).
+	StatusFailed = "failed"
+
+	// QueueKey is the Redis list jobs are pushed to and popped from.
+	QueueKey = "payment_operations:queue"
+
+	// DequeueTimeout bounds each BRPOP poll so workers can observe ctx
+	// cancellation instead of blocking on the list forever.
+	DequeueTimeout = 5 * time.Second
+
+	// DefaultConcurrency is how many worker goroutines a pool runs by default.
+	DefaultConcurrency = 4
+)
+
+// Job is the work item handed from the Idempotency middleware to a
+// WorkerPool: enough of the original request to replay it against the
+// wrapped handler out of band.
+type Job struct {
+	OperationID string      `json:"operation_id"`
+	Method      string      `json:"method"`
+	Path        string      `json:"path"`
+	Body        []byte      `json:"body"`
+	Headers     http.Header `json:"headers"`
+}
+
+// Queue pushes and pops Jobs through a Redis list.
+type Queue struct {
+	rdb *redis.Client
+}
+
+// NewQueue builds a Queue backed by rdb.
+func NewQueue(rdb *redis.Client) *Queue {
+	return &Queue{rdb: rdb}
+}
+
+// Enqueue pushes a job for a worker to pick up.
+func (q *Queue) Enqueue(ctx context.Context, job Job) error {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return q.rdb.LPush(ctx, QueueKey, body).Err()
+}
+
+// dequeue blocks for up to DequeueTimeout waiting for a job.
+func (q *Queue) dequeue(ctx context.Context) (Job, error) {
+	result, err := q.rdb.BRPop(ctx, DequeueTimeout, QueueKey).Result()
+	if err != nil {
+		return Job{}, err
+	}
+	var job Job
+	err = json.Unmarshal([]byte(result[1]), &job)
+	return job, err
+}
+
+// WorkerPool drains a Queue and replays each Job against handler, then
+// records the result on the matching payment_operations row.
+type WorkerPool struct {
+	queue       *Queue
+	db          *sql.DB
+	handler     http.Handler
+	concurrency int
+}
+
+// NewWorkerPool builds a pool of concurrency workers that process jobs from
+// queue by invoking handler and persisting the outcome to db.
+func NewWorkerPool(queue *Queue, db *sql.DB, handler http.Handler, concurrency int) *WorkerPool {
+	return &WorkerPool{queue: queue, db: db, handler: handler, concurrency: concurrency}
+}
+
+// Run starts the worker goroutines; they exit once ctx is cancelled.
+func (p *WorkerPool) Run(ctx context.Context) {
+	for i := 0; i < p.concurrency; i++ {
+		go p.work(ctx)
+	}
+}
+
+func (p *WorkerPool) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, err := p.queue.dequeue(ctx)
+		switch err {
+		case nil:
+			p.process(ctx, job)
+		case redis.Nil:
+			// Nothing to do this poll; try again.
+		default:
+			if ctx.Err() == nil {
+				log.Printf("[Operations] dequeue error: %v", err)
+			}
+		}
+	}
+}
+
+// process replays job against the wrapped handler using an in-memory
+// response recorder, then writes the terminal status back to the database.
+//
+// Unlike the synchronous path, which net/http recovers per-request, a panic
+// here (e.g. api.TransferHandler's CHAOS_MODE crash, replayed out of band)
+// would otherwise escape the worker goroutine and take down the whole
+// process along with every other worker. Recover it and fail just this
+// operation instead.
+func (p *WorkerPool) process(ctx context.Context, job Job) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[Operations] handler panicked for %s: %v", job.OperationID, r)
+			p.finish(job.OperationID, StatusFailed, errorBody("internal error"))
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, job.Method, job.Path, bytes.NewReader(job.Body))
+	if err != nil {
+		log.Printf("[Operations] failed to rebuild request for %s: %v", job.OperationID, err)
+		p.finish(job.OperationID, StatusFailed, errorBody("failed to rebuild request"))
+		return
+	}
+	req.Header = job.Headers
+
+	rec := &recorder{header: http.Header{}, statusCode: http.StatusOK}
+	p.handler.ServeHTTP(rec, req)
+
+	status := StatusFailed
+	if rec.statusCode >= 200 && rec.statusCode < 300 {
+		status = StatusSucceeded
+	}
+	p.finish(job.OperationID, status, jsonBody(rec))
+}
+
+// jsonBody returns rec's captured body unchanged if the handler wrote JSON
+// (the success path, and any handler that replies with a structured error),
+// or wraps a plaintext body (e.g. from http.Error, which most failure paths
+// use) into one - response_body is a JSONB column and OperationHandler
+// embeds it as a json.RawMessage, so it must always be valid JSON.
+func jsonBody(rec *recorder) []byte {
+	if strings.HasPrefix(rec.header.Get("Content-Type"), "application/json") {
+		return rec.body.Bytes()
+	}
+	return errorBody(strings.TrimSpace(rec.body.String()))
+}
+
+// errorBody builds the structured JSON error body stored for a failed
+// operation.
+func errorBody(message string) []byte {
+	body, _ := json.Marshal(map[string]string{"error": message})
+	return body
+}
+
+func (p *WorkerPool) finish(operationID, status string, body []byte) {
+	if _, err := p.db.Exec(
+		"UPDATE payment_operations SET status = $1, response_body = $2, updated_at = now() WHERE id = $3",
+		status, body, operationID,
+	); err != nil {
+		log.Printf("[Operations] failed to record result for %s: %v", operationID, err)
+	}
+}
+
+// recorder is a minimal in-memory http.ResponseWriter used to capture a
+// handler's response when it's invoked out of band by the worker pool.
+type recorder struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (r *recorder) Header() http.Header         { return r.header }
+func (r *recorder) WriteHeader(code int)        { r.statusCode = code }
+func (r *recorder) Write(b []byte) (int, error) { return r.body.Write(b) }
+
+// operationResponse is the JSON shape returned by OperationHandler.
+type operationResponse struct {
+	ID       string          `json:"id"`
+	Status   string          `json:"status"`
+	Response json.RawMessage `json:"response,omitempty"`
+}
+
+// OperationHandler returns the current status of an async operation and,
+// once it reaches a terminal state, the response its handler produced.
+func OperationHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		var status string
+		var responseBody sql.NullString
+		err := db.QueryRow(
+			"SELECT status, response_body FROM payment_operations WHERE id = $1", id,
+		).Scan(&status, &responseBody)
+		switch err {
+		case nil:
+			// fall through
+		case sql.ErrNoRows:
+			http.Error(w, "Operation not found", http.StatusNotFound)
+			return
+		default:
+			http.Error(w, "Database Error", http.StatusInternalServerError)
+			return
+		}
+
+		resp := operationResponse{ID: id, Status: status}
+		if status != StatusPending && responseBody.Valid {
+			resp.Response = json.RawMessage(responseBody.String)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
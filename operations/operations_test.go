@@ -0,0 +1,163 @@
+package operations
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi/v5"
+)
+
+// jsonHandler mimics a handler replying with a structured JSON body, the
+// way api.TransferHandler does on success.
+func jsonHandler(code int, body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		w.Write([]byte(body))
+	})
+}
+
+// plaintextHandler mimics http.Error, which most of api.TransferHandler's
+// failure paths use.
+func plaintextHandler(code int, message string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, message, code)
+	})
+}
+
+func TestProcess_StatusMapping(t *testing.T) {
+	cases := []struct {
+		name       string
+		handler    http.Handler
+		wantStatus string
+		wantBody   string
+	}{
+		{"2xx succeeds", jsonHandler(http.StatusOK, `{"status":"success"}`), StatusSucceeded, `{"status":"success"}`},
+		{"201 succeeds", jsonHandler(http.StatusCreated, `{"status":"success"}`), StatusSucceeded, `{"status":"success"}`},
+		{"4xx validation failure is not succeeded", plaintextHandler(http.StatusUnprocessableEntity, "Insufficient Funds"), StatusFailed, `{"error":"Insufficient Funds"}`},
+		{"400 bad request is not succeeded", plaintextHandler(http.StatusBadRequest, "Unknown account"), StatusFailed, `{"error":"Unknown account"}`},
+		{"5xx fails", plaintextHandler(http.StatusInternalServerError, "Database Error"), StatusFailed, `{"error":"Database Error"}`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New: %v", err)
+			}
+			defer db.Close()
+
+			mock.ExpectExec("UPDATE payment_operations SET status = \\$1, response_body = \\$2, updated_at = now\\(\\) WHERE id = \\$3").
+				WithArgs(c.wantStatus, []byte(c.wantBody), "op-1").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			pool := NewWorkerPool(nil, db, c.handler, DefaultConcurrency)
+			job := Job{OperationID: "op-1", Method: http.MethodPost, Path: "/transfer", Body: nil, Headers: http.Header{}}
+			pool.process(context.Background(), job)
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestProcess_RecoversHandlerPanic(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("UPDATE payment_operations SET status = \\$1, response_body = \\$2, updated_at = now\\(\\) WHERE id = \\$3").
+		WithArgs(StatusFailed, []byte(`{"error":"internal error"}`), "op-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	panicky := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("intentional chaos crash")
+	})
+
+	pool := NewWorkerPool(nil, db, panicky, DefaultConcurrency)
+	job := Job{OperationID: "op-1", Method: http.MethodPost, Path: "/transfer", Body: nil, Headers: http.Header{}}
+
+	pool.process(context.Background(), job)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func requestWithID(id string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/operations/"+id, nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", id)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func TestOperationHandler_Pending(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT status, response_body FROM payment_operations WHERE id = \\$1").
+		WithArgs("op-1").
+		WillReturnRows(sqlmock.NewRows([]string{"status", "response_body"}).AddRow(StatusPending, nil))
+
+	w := httptest.NewRecorder()
+	OperationHandler(db)(w, requestWithID("op-1"))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := w.Body.String(); got != `{"id":"op-1","status":"pending"}`+"\n" {
+		t.Errorf("body = %q, want pending status with no response", got)
+	}
+}
+
+func TestOperationHandler_Terminal(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT status, response_body FROM payment_operations WHERE id = \\$1").
+		WithArgs("op-2").
+		WillReturnRows(sqlmock.NewRows([]string{"status", "response_body"}).
+			AddRow(StatusSucceeded, `{"status":"success"}`))
+
+	w := httptest.NewRecorder()
+	OperationHandler(db)(w, requestWithID("op-2"))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := w.Body.String(); got != `{"id":"op-2","status":"succeeded","response":{"status":"success"}}`+"\n" {
+		t.Errorf("body = %q, want terminal response included", got)
+	}
+}
+
+func TestOperationHandler_NotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT status, response_body FROM payment_operations WHERE id = \\$1").
+		WithArgs("missing").
+		WillReturnError(sql.ErrNoRows)
+
+	w := httptest.NewRecorder()
+	OperationHandler(db)(w, requestWithID("missing"))
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,346 @@
+// Package outbox implements the transactional outbox pattern: domain events
+// are written in the same SQL transaction as the state change they describe,
+// then delivered to downstream systems by a background dispatcher. This
+// closes the gap where a commit succeeds but the process crashes (or panics,
+// see CHAOS_MODE in api.TransferHandler) before a webhook is fired.
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// PollInterval is how often the dispatcher checks for due events.
+	PollInterval = 2 * time.Second
+
+	// BatchSize caps how many pending events are claimed per poll.
+	BatchSize = 20
+
+	// MaxAttempts is how many delivery attempts are made before an event
+	// is moved to the dead_letter table.
+	MaxAttempts = 8
+
+	// baseBackoff and capBackoff bound the exponential retry backoff:
+	// base*2^attempts, capped, plus jitter.
+	baseBackoff = 1 * time.Second
+	capBackoff  = 5 * time.Minute
+
+	// deliveryTimeout bounds each webhook POST.
+	deliveryTimeout = 10 * time.Second
+
+	// reclaimMargin is added on top of deliveryTimeout when claimBatch
+	// pushes next_attempt_at forward, so an in-flight delivery can't
+	// possibly still be running by the time the next poll could re-claim
+	// the same row.
+	reclaimMargin = 5 * time.Second
+)
+
+// Event is a row of the transactional outbox.
+type Event struct {
+	ID        string
+	EventType string
+	Payload   []byte
+	Attempts  int
+}
+
+// InsertEvent records a domain event inside the caller's transaction so it
+// commits atomically with the state change it describes.
+func InsertEvent(tx *sql.Tx, eventType string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO transaction_events (event_type, payload) VALUES ($1, $2)",
+		eventType, body,
+	)
+	return err
+}
+
+// Dispatcher polls transaction_events for due rows and delivers them to a
+// webhook endpoint, retrying with exponential backoff and jitter on failure.
+type Dispatcher struct {
+	db         *sql.DB
+	webhookURL string
+	client     *http.Client
+}
+
+// NewDispatcher builds a Dispatcher that POSTs events to webhookURL.
+func NewDispatcher(db *sql.DB, webhookURL string) *Dispatcher {
+	return &Dispatcher{
+		db:         db,
+		webhookURL: webhookURL,
+		client:     &http.Client{Timeout: deliveryTimeout},
+	}
+}
+
+// Run polls for due events until ctx is cancelled. It's meant to be started
+// as a background goroutine from main.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.dispatchBatch(ctx); err != nil {
+				log.Printf("[Outbox] dispatch batch error: %v", err)
+			}
+		}
+	}
+}
+
+// dispatchBatch claims a batch of due events, then delivers each one with no
+// transaction open: claiming commits before any webhook POST is made, so a
+// slow or hung endpoint only holds up its own event, not a DB connection and
+// row locks for the whole batch.
+func (d *Dispatcher) dispatchBatch(ctx context.Context) error {
+	events, err := d.claimBatch(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		d.deliver(ctx, e)
+	}
+
+	return nil
+}
+
+// claimBatch reserves a batch of due events with SELECT ... FOR UPDATE SKIP
+// LOCKED (so multiple dispatcher instances can run concurrently without
+// double-claiming a row), pushes their next_attempt_at past deliveryTimeout
+// times the batch size (the events are delivered one after another, so that
+// is the longest the last one can still be waiting or in flight) so a row
+// isn't re-claimed by a following poll before it could have finished, and
+// commits - all before any webhook request is made.
+func (d *Dispatcher) claimBatch(ctx context.Context) ([]Event, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, event_type, payload, attempts
+		FROM transaction_events
+		WHERE delivered_at IS NULL AND next_attempt_at <= now()
+		ORDER BY created_at
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED`, BatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.ID, &e.EventType, &e.Payload, &e.Attempts); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+
+	for _, e := range events {
+		if _, err := tx.ExecContext(ctx,
+			"UPDATE transaction_events SET next_attempt_at = $1 WHERE id = $2",
+			time.Now().Add(time.Duration(len(events))*deliveryTimeout+reclaimMargin), e.ID,
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	return events, tx.Commit()
+}
+
+// deliver POSTs a single claimed event and records the outcome in a short
+// follow-up statement, outside of any long-lived transaction.
+func (d *Dispatcher) deliver(ctx context.Context, e Event) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.webhookURL, bytes.NewReader(e.Payload))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		// Receivers dedupe deliveries keyed on the event id.
+		req.Header.Set("Idempotency-Key", e.ID)
+	}
+
+	var resp *http.Response
+	if err == nil {
+		resp, err = d.client.Do(req)
+	}
+
+	if err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		resp.Body.Close()
+		if _, err := d.db.ExecContext(ctx, "UPDATE transaction_events SET delivered_at = now() WHERE id = $1", e.ID); err != nil {
+			log.Printf("[Outbox] failed to mark event %s delivered: %v", e.ID, err)
+		}
+		return
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	log.Printf("[Outbox] delivery failed for event %s: %v", e.ID, err)
+
+	attempts := e.Attempts + 1
+	if attempts >= MaxAttempts {
+		d.deadLetter(ctx, e, attempts)
+		return
+	}
+
+	next := nextAttemptAt(attempts)
+	if _, err := d.db.ExecContext(ctx,
+		"UPDATE transaction_events SET attempts = $1, next_attempt_at = $2 WHERE id = $3",
+		attempts, next, e.ID); err != nil {
+		log.Printf("[Outbox] failed to reschedule event %s: %v", e.ID, err)
+	}
+}
+
+func (d *Dispatcher) deadLetter(ctx context.Context, e Event, attempts int) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("[Outbox] failed to dead-letter event %s: %v", e.ID, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO dead_letter (id, event_type, payload, attempts)
+		VALUES ($1, $2, $3, $4)`, e.ID, e.EventType, e.Payload, attempts); err != nil {
+		log.Printf("[Outbox] failed to dead-letter event %s: %v", e.ID, err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM transaction_events WHERE id = $1", e.ID); err != nil {
+		log.Printf("[Outbox] failed to remove dead-lettered event %s: %v", e.ID, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("[Outbox] failed to commit dead-letter for event %s: %v", e.ID, err)
+	}
+}
+
+// nextAttemptAt computes the next retry time using exponential backoff with
+// jitter: base*2^attempts, capped, +/-20% jitter.
+func nextAttemptAt(attempts int) time.Time {
+	backoff := time.Duration(float64(baseBackoff) * math.Pow(2, float64(attempts)))
+	if backoff > capBackoff {
+		backoff = capBackoff
+	}
+	jitter := time.Duration((rand.Float64()*0.4 - 0.2) * float64(backoff))
+	return time.Now().Add(backoff + jitter)
+}
+
+// pendingEvent is the JSON shape returned by PendingHandler.
+type pendingEvent struct {
+	ID            string          `json:"id"`
+	EventType     string          `json:"event_type"`
+	Payload       json.RawMessage `json:"payload"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+}
+
+// PendingHandler lists outbox events that have not yet been delivered, for
+// operator visibility into at-least-once delivery lag.
+func PendingHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(`
+			SELECT id, event_type, payload, created_at, attempts, next_attempt_at
+			FROM transaction_events
+			WHERE delivered_at IS NULL
+			ORDER BY created_at`)
+		if err != nil {
+			http.Error(w, "Database Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		pending := []pendingEvent{}
+		for rows.Next() {
+			var e pendingEvent
+			if err := rows.Scan(&e.ID, &e.EventType, &e.Payload, &e.CreatedAt, &e.Attempts, &e.NextAttemptAt); err != nil {
+				http.Error(w, "Database Error", http.StatusInternalServerError)
+				return
+			}
+			pending = append(pending, e)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pending)
+	}
+}
+
+// RetryHandler forces an event to be retried on the dispatcher's next poll.
+// It also recovers events that already fell through to the dead letter
+// table, re-queuing them with a reset attempt count.
+func RetryHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		result, err := db.Exec("UPDATE transaction_events SET next_attempt_at = now() WHERE id = $1", id)
+		if err != nil {
+			http.Error(w, "Database Error", http.StatusInternalServerError)
+			return
+		}
+		if rows, _ := result.RowsAffected(); rows > 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		requeueFromDeadLetter(w, db, id)
+	}
+}
+
+// requeueFromDeadLetter moves an event back into transaction_events so the
+// dispatcher picks it up again, since it isn't in the live table anymore.
+func requeueFromDeadLetter(w http.ResponseWriter, db *sql.DB, id string) {
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database Error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var eventType string
+	var payload []byte
+	err = tx.QueryRow("SELECT event_type, payload FROM dead_letter WHERE id = $1", id).Scan(&eventType, &payload)
+	switch err {
+	case nil:
+		// Found it; fall through to requeue.
+	case sql.ErrNoRows:
+		http.Error(w, "Event not found", http.StatusNotFound)
+		return
+	default:
+		http.Error(w, "Database Error", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO transaction_events (id, event_type, payload, attempts) VALUES ($1, $2, $3, 0)",
+		id, eventType, payload); err != nil {
+		http.Error(w, "Database Error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM dead_letter WHERE id = $1", id); err != nil {
+		http.Error(w, "Database Error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Commit Failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
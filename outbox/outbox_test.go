@@ -0,0 +1,102 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestNextAttemptAt(t *testing.T) {
+	before := time.Now()
+	next := nextAttemptAt(0)
+	// attempts=0: backoff is baseBackoff (1s) +/- 20% jitter.
+	if d := next.Sub(before); d < 700*time.Millisecond || d > 1300*time.Millisecond {
+		t.Errorf("nextAttemptAt(0) backoff = %v, want ~1s +/- jitter", d)
+	}
+
+	// A high attempt count must still be capped at capBackoff (plus jitter),
+	// not grow unbounded with 2^attempts.
+	before = time.Now()
+	next = nextAttemptAt(30)
+	if d := next.Sub(before); d > capBackoff+capBackoff/5 {
+		t.Errorf("nextAttemptAt(30) backoff = %v, want capped around %v", d, capBackoff)
+	}
+}
+
+func requestWithID(method, target, id string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", id)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func TestRetryHandler_RequeuesFromDeadLetter(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("UPDATE transaction_events SET next_attempt_at = now\\(\\) WHERE id = \\$1").
+		WithArgs("evt-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT event_type, payload FROM dead_letter WHERE id = \\$1").
+		WithArgs("evt-1").
+		WillReturnRows(sqlmock.NewRows([]string{"event_type", "payload"}).
+			AddRow("transfer.completed", []byte(`{"amount":10}`)))
+	mock.ExpectExec("INSERT INTO transaction_events").
+		WithArgs("evt-1", "transfer.completed", []byte(`{"amount":10}`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM dead_letter WHERE id = \\$1").
+		WithArgs("evt-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	req := requestWithID(http.MethodPost, "/outbox/evt-1/retry", "evt-1")
+	w := httptest.NewRecorder()
+	RetryHandler(db)(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d (body: %s)", w.Code, http.StatusNoContent, w.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestRetryHandler_NotFoundAnywhere(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("UPDATE transaction_events SET next_attempt_at = now\\(\\) WHERE id = \\$1").
+		WithArgs("missing").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT event_type, payload FROM dead_letter WHERE id = \\$1").
+		WithArgs("missing").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	req := requestWithID(http.MethodPost, "/outbox/missing/retry", "missing")
+	w := httptest.NewRecorder()
+	RetryHandler(db)(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
@@ -1,7 +1,13 @@
+//go:build ignore
+
 // Package main provides a concurrent stress test for idempotent payment APIs.
 // It validates that the system prevents duplicate transactions even under
 // high concurrency by sending multiple simultaneous requests with the same
 // idempotency key.
+//
+// Run directly with `go run stress_tester.go` - the build tag keeps it out
+// of `go build ./...`/`go vet ./...`, since it's a second `package main` in
+// the module root and would otherwise collide with main.go.
 package main
 
 import (
@@ -121,6 +127,12 @@ func setupTestEnvironment(fromID, toID int, initialBalance float64) error {
 		return fmt.Errorf("failed to create accounts table: %w", err)
 	}
 
+	// Defensive: the real server adds this column via db.Initialize, but
+	// this script may run against a database it provisioned itself.
+	if _, err := db.Exec(`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS is_credit_line BOOLEAN NOT NULL DEFAULT false;`); err != nil {
+		return fmt.Errorf("failed to add is_credit_line column to accounts table: %w", err)
+	}
+
 	if _, err := db.Exec(createTransactionsTable); err != nil {
 		return fmt.Errorf("failed to create transactions table: %w", err)
 	}
@@ -136,10 +148,15 @@ func setupTestEnvironment(fromID, toID int, initialBalance float64) error {
 		// Calculate required balance for sender
 		requiredBalance := initialBalance * 100
 
-		// Insert or update accounts
+		// The ledger's overdraft guard only lets a debit through if the
+		// account's computed balance covers it, and a brand new ledger has
+		// nothing to debit from. Mark the sender as a credit-line account
+		// (accounts.is_credit_line) so it can fund the receiver; legacy
+		// accounts.balance is no longer read by the ledger, but it's kept
+		// populated here for anyone still querying it directly.
 		_, err = db.Exec(`
-			INSERT INTO accounts (id, balance) VALUES ($1, $2), ($3, 0)
-			ON CONFLICT (id) DO UPDATE SET balance = EXCLUDED.balance`,
+			INSERT INTO accounts (id, balance, is_credit_line) VALUES ($1, $2, true), ($3, 0, false)
+			ON CONFLICT (id) DO UPDATE SET balance = EXCLUDED.balance, is_credit_line = EXCLUDED.is_credit_line`,
 			fromID, requiredBalance, toID)
 		if err != nil {
 			return fmt.Errorf("failed to create accounts: %w", err)